@@ -4,21 +4,46 @@
 package cli
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
-	"tailscale.com/util/lineread"
+	"github.com/pkg/diff"
+	"tailscale.com/cmd/tailscale/cli/sshconfig"
 )
 
+// Legacy magic-block markers. These are no longer written, but are still
+// recognized so that configs generated by older versions of this command
+// can be migrated to the Include-file layout below.
 const tsConfigStartMark = "## BEGIN Tailscale ##"
 const tsConfigEndMark = "## END Tailscale ##"
 
+// tsIncludeFileName is the name of the file, relative to ~/.ssh, that holds
+// the Tailscale-managed ssh_config snippet. Tailscale owns this file end to
+// end and rewrites it in full on every invocation; ~/.ssh/config itself only
+// gets a single Include line pointing at it.
+const tsIncludeFileName = "tailscale_config"
+
+// tsManagedHeader is written as the first line of the managed include file.
+const tsManagedHeader = "# Managed by tailscale — do not edit. Run `tailscale configure sshconfig` to regenerate."
+
+// tsOptionsPrefix marks the line in the managed include file that records
+// the options used to produce it, e.g. "# ts-options: binary=/usr/bin/tailscale".
+const tsOptionsPrefix = "# ts-options: "
+
+// errChangesPending is returned by Exec when --diff finds changes that
+// would be made; the caller's normal error handling turns this into a
+// non-zero exit code without us calling os.Exit ourselves.
+var errChangesPending = errors.New("ssh config changes are pending")
+
 func init() {
 	configureCmd.Subcommands = append(configureCmd.Subcommands, configureSSHconfigCmd)
 }
@@ -33,36 +58,135 @@ Tailscale for KnownHosts.
 
 You can use this snippet by running: tailscale sshconfig >> $HOME/.ssh/config
 or copy and paste it into your $HOME/.ssh/config file.
+
+Pass --remove to undo a previous run: this deletes the Tailscale-managed
+config instead of installing it.
 `),
 	Exec: runConfigureSSHconfig,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("sshconfig")
 		fs.BoolVar(&sshConfigArgs.export, "export", false, "export the config snippet to stdout or modify $HOME/.ssh/config in place")
+		fs.BoolVar(&sshConfigArgs.diff, "diff", false, "print a diff of the changes that would be made, without writing anything; exit 0 if none are pending, 1 otherwise")
+		fs.BoolVar(&sshConfigArgs.yes, "yes", false, "apply changes without prompting for confirmation")
+		fs.BoolVar(&sshConfigArgs.force, "force", false, "write the managed config even if it conflicts with an existing Host block or global option")
+		fs.BoolVar(&sshConfigArgs.remove, "remove", false, "remove any Tailscale-managed ssh config instead of installing it")
 		return fs
 	})(),
 }
 
 var sshConfigArgs struct {
 	export bool // export the config snippet to stdout or modify in place
+	diff   bool // print a diff of pending changes and exit without writing
+	yes    bool // apply changes without prompting
+	force  bool // write even if a conflict with the user's existing config is detected
+	remove bool // remove any Tailscale-managed config instead of installing it
 }
 
-func replaceBetween[S ~[]T, T any](s S, start, end int, replacement []T) S {
-	if start < 0 || end < 0 || start > end || end > len(s) {
-		panic("invalid indices")
+// tsHostPattern is the Host pattern Tailscale's managed snippet matches.
+const tsHostPattern = "*.ts.net"
+
+// tsHostKeys are the ssh_config options Tailscale's managed snippet sets.
+// If the user's own ~/.ssh/config already sets any of these, either in a
+// conflicting Host block or globally, installing our snippet would silently
+// change behavior the user configured, so we refuse to write unless --force
+// is passed.
+var tsHostKeys = []string{"UserKnownHostsFile", "KnownHostsCommand"}
+
+// tsOptions is the set of knobs used to produce the managed ssh_config
+// snippet. It is persisted as a comment in the managed include file so that
+// regenerating the snippet is idempotent even if this run's environment
+// (e.g. $PATH, and so the resolved binary path) differs from the run that
+// last wrote the file.
+type tsOptions map[string]string
+
+// String formats o as space-separated key=value pairs, in a stable order.
+func (o tsOptions) String() string {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + o[k]
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseTsOptions looks for a tsOptionsPrefix line in include and parses it
+// into a tsOptions. Its second return reports whether such a line was found.
+func parseTsOptions(include string) (tsOptions, bool) {
+	for _, line := range strings.Split(include, "\n") {
+		rest, ok := strings.CutPrefix(line, tsOptionsPrefix)
+		if !ok {
+			continue
+		}
+		opts := tsOptions{}
+		for _, tok := range strings.Fields(rest) {
+			if k, v, ok := strings.Cut(tok, "="); ok {
+				opts[k] = v
+			}
+		}
+		return opts, true
+	}
+	return nil, false
+}
+
+// resolveTsOptions decides which set of options to use for this run, given
+// requested (what this invocation would use) and the options persisted from
+// a previous run (if any). If they agree, or there's nothing persisted yet,
+// requested is used with no prompting. Otherwise, --yes selects requested
+// without prompting; without --yes, if interactive, the user is asked
+// whether to switch to the new options; declining, or passing
+// interactive=false (as --diff does, to preview what a non-interactive run
+// without --yes would do), keeps using the persisted options so that
+// regenerating the snippet from a different environment doesn't flip-flop
+// the file.
+func resolveTsOptions(requested tsOptions, persisted tsOptions, hadPersisted, interactive bool) (tsOptions, error) {
+	if !hadPersisted || requested.String() == persisted.String() {
+		return requested, nil
+	}
+
+	useNew := sshConfigArgs.yes
+	if !useNew && interactive {
+		fmt.Printf("Previously used options: %s\n", persisted)
+		fmt.Printf("Requested options:       %s\n", requested)
+		ok, err := confirm("Use new options? [y/N] ")
+		if err != nil {
+			return nil, err
+		}
+		useNew = ok
 	}
-	if start == end {
-		return s
+	if useNew {
+		return requested, nil
 	}
-	return append(append(s[:start+1:start+1], replacement...), s[end:]...)
+	return persisted, nil
 }
 
-// runConfigureSSHconfig updates the user's $HOME/.ssh/config file to add the
-// Tailscale config snippet. If the snippet is not present, it will be appended
-// between the BEGIN and END marks. If it is present it will be updated if needed.
+// runConfigureSSHconfig updates the user's $HOME/.ssh/config file to check
+// Tailscale for KnownHosts. The generated snippet is written in full to a
+// dedicated file that Tailscale owns (tsIncludeFileName), and ~/.ssh/config
+// is left with a single Include line pointing at it. A legacy magic-block
+// snippet, if found, is migrated out of ~/.ssh/config and replaced with the
+// Include line. Before writing, ~/.ssh/config (with any legacy block of
+// ours already stripped out, so it isn't mistaken for a conflict with
+// itself) is parsed with the sshconfig package and checked for a
+// pre-existing Host block or global option that would conflict with what
+// Tailscale's snippet sets; if found, runConfigureSSHconfig refuses to
+// write unless --force is passed.
 func runConfigureSSHconfig(ctx context.Context, args []string) error {
 	if len(args) > 0 {
 		return errors.New("unexpected non-flag arguments to 'tailscale status'")
 	}
+
+	if sshConfigArgs.remove {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		return runRemoveSSHconfig(h)
+	}
+
 	tailscaleBin, err := os.Executable()
 	if err != nil {
 		return err
@@ -71,68 +195,327 @@ func runConfigureSSHconfig(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
+	h, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
 
-	tsSshConfig, err := genSSHConfig(st, tailscaleBin)
+	if sshConfigArgs.export {
+		tsSshConfig, err := genSSHConfig(st, tailscaleBin)
+		if err != nil {
+			return err
+		}
+		fmt.Println(tsSshConfig)
+		return nil
+	}
+
+	sshConfigFilePath := filepath.FromSlash(h + "/.ssh/config")
+	includeFilePath := filepath.FromSlash(h + "/.ssh/" + tsIncludeFileName)
+	includeLine := "Include " + filepath.FromSlash("~/.ssh/"+tsIncludeFileName)
+
+	curConfig, err := readFileOrEmpty(sshConfigFilePath)
 	if err != nil {
 		return err
 	}
-	h, err := os.UserHomeDir()
+	curInclude, err := readFileOrEmpty(includeFilePath)
 	if err != nil {
 		return err
 	}
 
-	if !sshConfigArgs.export {
-		sshConfigFilePath := filepath.FromSlash(h + "/.ssh/config")
-		fmt.Println(sshConfigFilePath)
-		var sshConfig []string
+	// --diff is a read-only preview, so it must never block on the
+	// interactive "use new options?" prompt; pass interactive=false so it
+	// resolves options exactly as a non-interactive run without --yes
+	// would, instead of always using the freshly requested ones.
+	requestedOpts := tsOptions{"binary": tailscaleBin}
+	persistedOpts, hadPersisted := parseTsOptions(curInclude)
+	opts, err := resolveTsOptions(requestedOpts, persistedOpts, hadPersisted, !sshConfigArgs.diff)
+	if err != nil {
+		return err
+	}
+	tailscaleBin = opts["binary"]
 
-		// Create the file if it does not exist
-		_, err = os.OpenFile(sshConfigFilePath, os.O_RDONLY|os.O_CREATE, 0644)
+	tsSshConfig, err := genSSHConfig(st, tailscaleBin)
+	if err != nil {
+		return err
+	}
+
+	if !sshConfigArgs.force {
+		strippedConfig := strings.Join(stripLegacyBlock(curConfig), "\n")
+		conflicts, err := sshconfig.FindConflicts(sshConfigFilePath, strippedConfig, tsHostPattern, tsHostKeys)
 		if err != nil {
 			return err
 		}
+		if len(conflicts) > 0 {
+			fmt.Fprintln(os.Stderr, "tailscale: refusing to write ssh config; found conflicting entries:")
+			for _, c := range conflicts {
+				fmt.Fprintf(os.Stderr, "  %s\n", c)
+			}
+			fmt.Fprintln(os.Stderr, "Resolve the conflict above, or pass --force to overwrite it.")
+			return errors.New("conflicting ssh config entries found")
+		}
+	}
+
+	newConfig := mergeIncludeLine(curConfig, includeLine)
+	newInclude := tsManagedHeader + "\n" + tsOptionsPrefix + opts.String() + "\n" + tsSshConfig + "\n"
 
-		err = lineread.File(sshConfigFilePath, func(line []byte) error {
-			sshConfig = append(sshConfig, string(line))
+	configChanged := newConfig != curConfig
+	includeChanged := newInclude != curInclude
+
+	if sshConfigArgs.diff {
+		if !configChanged && !includeChanged {
 			return nil
-		})
-		if err != nil {
-			return err
 		}
-
-		start, end := findConfigMark(sshConfig)
-		if start == -1 || end == -1 {
-			sshConfig = append(sshConfig, tsConfigStartMark)
-			sshConfig = append(sshConfig, tsSshConfig)
-			sshConfig = append(sshConfig, tsConfigEndMark)
-		} else {
-			existingConfig := strings.Join(sshConfig[start+1:end], "\n")
-			if existingConfig != tsSshConfig {
-				sshConfig = replaceBetween(sshConfig, start+1, end, []string{tsSshConfig})
+		if configChanged {
+			if err := printDiff(os.Stdout, sshConfigFilePath, curConfig, newConfig); err != nil {
+				return err
 			}
 		}
+		if includeChanged {
+			if err := printDiff(os.Stdout, includeFilePath, curInclude, newInclude); err != nil {
+				return err
+			}
+		}
+		return errChangesPending
+	}
 
-		sshFile, err := os.Create(sshConfigFilePath)
+	if !configChanged && !includeChanged {
+		fmt.Println("Nothing to do; ssh config is already up to date")
+		return nil
+	}
+
+	if !sshConfigArgs.yes {
+		if configChanged {
+			if err := printDiff(os.Stdout, sshConfigFilePath, curConfig, newConfig); err != nil {
+				return err
+			}
+		}
+		if includeChanged {
+			if err := printDiff(os.Stdout, includeFilePath, curInclude, newInclude); err != nil {
+				return err
+			}
+		}
+		ok, err := confirm(fmt.Sprintf("Update %s? [y/N] ", sshConfigFilePath))
 		if err != nil {
 			return err
+		}
+		if !ok {
+			fmt.Println("Not making changes")
+			return nil
+		}
+	}
+
+	if configChanged {
+		if err := atomicWriteFile(sshConfigFilePath, []byte(newConfig)); err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s\n", sshConfigFilePath)
+	}
+	if includeChanged {
+		if err := atomicWriteFile(includeFilePath, []byte(newInclude)); err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s\n", includeFilePath)
+	}
+
+	return nil
+}
+
+// runRemoveSSHconfig deletes any Tailscale-managed content from
+// ~/.ssh/config: the legacy magic-block, the Include line pointing at the
+// managed include file, and the managed include file itself. It shares the
+// atomic-write path, diff preview, and confirmation prompt with
+// runConfigureSSHconfig's install path.
+func runRemoveSSHconfig(h string) error {
+	sshConfigFilePath := filepath.FromSlash(h + "/.ssh/config")
+	includeFilePath := filepath.FromSlash(h + "/.ssh/" + tsIncludeFileName)
+	includeLine := "Include " + filepath.FromSlash("~/.ssh/"+tsIncludeFileName)
 
+	curConfig, err := readFileOrEmpty(sshConfigFilePath)
+	if err != nil {
+		return err
+	}
+	curInclude, err := readFileOrEmpty(includeFilePath)
+	if err != nil {
+		return err
+	}
+
+	lines := stripLegacyBlock(curConfig)
+	configChanged := strings.Contains(curConfig, tsConfigStartMark) && strings.Contains(curConfig, tsConfigEndMark)
+	if idx := findIncludeLine(lines, includeLine); idx != -1 {
+		lines = append(lines[:idx], lines[idx+1:]...)
+		configChanged = true
+	}
+	newConfig := ""
+	if len(lines) > 0 {
+		newConfig = strings.Join(lines, "\n") + "\n"
+	}
+
+	removeInclude := curInclude != ""
+
+	if !configChanged && !removeInclude {
+		fmt.Println("No Tailscale-managed ssh config found; nothing to do")
+		return nil
+	}
+
+	if sshConfigArgs.diff {
+		if configChanged {
+			if err := printDiff(os.Stdout, sshConfigFilePath, curConfig, newConfig); err != nil {
+				return err
+			}
+		}
+		if removeInclude {
+			if err := printDiff(os.Stdout, includeFilePath, curInclude, ""); err != nil {
+				return err
+			}
 		}
-		defer sshFile.Close()
+		return errChangesPending
+	}
 
-		for _, line := range sshConfig {
-			_, err := sshFile.WriteString(line + "\n")
-			if err != nil {
+	if !sshConfigArgs.yes {
+		if configChanged {
+			if err := printDiff(os.Stdout, sshConfigFilePath, curConfig, newConfig); err != nil {
+				return err
+			}
+		}
+		if removeInclude {
+			if err := printDiff(os.Stdout, includeFilePath, curInclude, ""); err != nil {
 				return err
 			}
 		}
+		ok, err := confirm("Remove Tailscale-managed ssh config? [y/N] ")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("Not making changes")
+			return nil
+		}
+	}
+
+	if configChanged {
+		if err := atomicWriteFile(sshConfigFilePath, []byte(newConfig)); err != nil {
+			return err
+		}
 		fmt.Printf("Updated %s\n", sshConfigFilePath)
-	} else {
-		fmt.Println(tsSshConfig)
+	}
+	if removeInclude {
+		if err := os.Remove(includeFilePath); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", includeFilePath)
 	}
 
 	return nil
 }
 
+// readFileOrEmpty reads path and returns its contents, or the empty string
+// if path does not exist.
+func readFileOrEmpty(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// stripLegacyBlock returns config's lines with the legacy Tailscale
+// magic-block removed, if present.
+func stripLegacyBlock(config string) []string {
+	var lines []string
+	if config != "" {
+		lines = strings.Split(strings.TrimRight(config, "\n"), "\n")
+	}
+	if start, end := findConfigMark(lines); start != -1 && end != -1 {
+		lines = append(lines[:start], lines[end+1:]...)
+	}
+	return lines
+}
+
+// mergeIncludeLine returns config with the legacy Tailscale magic-block
+// removed, if present, and includeLine added as its first line unless it is
+// already present; an existing includeLine is left where it is.
+func mergeIncludeLine(config, includeLine string) string {
+	lines := stripLegacyBlock(config)
+	if findIncludeLine(lines, includeLine) == -1 {
+		lines = append([]string{includeLine}, lines...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// printDiff writes a unified diff between before and after to w, labeled
+// with name.
+func printDiff(w io.Writer, name, before, after string) error {
+	return diff.Text(name, name, strings.NewReader(before), strings.NewReader(after), w)
+}
+
+// sshConfigStdin is shared across confirm calls within a run. A run can
+// prompt more than once (e.g. the "use new options?" prompt followed by the
+// final "update config?" prompt); over a piped, non-terminal stdin a fresh
+// bufio.Scanner per call can read ahead and buffer both answers in one
+// syscall, silently starving the second prompt. It's named distinctly from
+// the generic "stdin" since it lives at package scope in cli, which is
+// shared by every subcommand.
+var sshConfigStdin = bufio.NewReader(os.Stdin)
+
+// confirm prints prompt to stdout and reads a yes/no answer from stdin. It
+// returns true only if the user answers with "y" or "yes" (case-insensitive).
+func confirm(prompt string) (bool, error) {
+	fmt.Print(prompt)
+	line, err := sshConfigStdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// atomicWriteFile atomically replaces path with content: it writes content
+// to a tempfile in the same directory, fsyncs it, and renames it into place,
+// preserving path's existing file mode (or 0644 if path doesn't exist yet).
+// The tempfile is removed if any step fails.
+func atomicWriteFile(path string, content []byte) (err error) {
+	mode := os.FileMode(0644)
+	if fi, statErr := os.Stat(path); statErr == nil {
+		mode = fi.Mode()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return nil
+}
+
 // findConfigMark finds and returns the index of the tsConfigStartMark and
 // tsConfigEndmark in a file. If the file doesn't contain the marks, it returns
 // -1, -1
@@ -149,3 +532,14 @@ func findConfigMark(file []string) (int, int) {
 	}
 	return start, end
 }
+
+// findIncludeLine returns the index of a line equal to includeLine (ignoring
+// surrounding whitespace), or -1 if it is not present in file.
+func findIncludeLine(file []string, includeLine string) int {
+	for i, v := range file {
+		if strings.TrimSpace(v) == includeLine {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,335 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStripLegacyBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "no legacy block",
+			config: "Host example.com\n  User alice\n",
+			want:   []string{"Host example.com", "  User alice"},
+		},
+		{
+			name: "legacy block removed",
+			config: "Host example.com\n" +
+				"  User alice\n" +
+				tsConfigStartMark + "\n" +
+				"Host *.ts.net\n" +
+				"  UserKnownHostsFile /dev/null\n" +
+				tsConfigEndMark + "\n",
+			want: []string{"Host example.com", "  User alice"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stripLegacyBlock(tt.config)
+			if !equalLines(got, tt.want) {
+				t.Errorf("stripLegacyBlock(%q) = %q, want %q", tt.config, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindConfigMark(t *testing.T) {
+	lines := []string{
+		"Host example.com",
+		tsConfigStartMark,
+		"Host *.ts.net",
+		tsConfigEndMark,
+	}
+	start, end := findConfigMark(lines)
+	if start != 1 || end != 3 {
+		t.Errorf("findConfigMark(%q) = (%d, %d), want (1, 3)", lines, start, end)
+	}
+
+	if start, end := findConfigMark([]string{"Host example.com"}); start != -1 || end != -1 {
+		t.Errorf("findConfigMark with no marks = (%d, %d), want (-1, -1)", start, end)
+	}
+}
+
+func TestFindIncludeLine(t *testing.T) {
+	includeLine := "Include ~/.ssh/tailscale_config"
+	lines := []string{"Host example.com", "  " + includeLine, "  User alice"}
+	if idx := findIncludeLine(lines, includeLine); idx != 1 {
+		t.Errorf("findIncludeLine = %d, want 1", idx)
+	}
+	if idx := findIncludeLine([]string{"Host example.com"}, includeLine); idx != -1 {
+		t.Errorf("findIncludeLine with no match = %d, want -1", idx)
+	}
+}
+
+func TestMergeIncludeLine(t *testing.T) {
+	includeLine := "Include ~/.ssh/tailscale_config"
+
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "empty config gets include line",
+			config: "",
+			want:   includeLine + "\n",
+		},
+		{
+			name:   "include line already present is left alone",
+			config: includeLine + "\nHost example.com\n",
+			want:   includeLine + "\nHost example.com\n",
+		},
+		{
+			name: "legacy block is migrated to an include line",
+			config: "Host example.com\n" +
+				tsConfigStartMark + "\n" +
+				"Host *.ts.net\n" +
+				tsConfigEndMark + "\n",
+			want: includeLine + "\nHost example.com\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeIncludeLine(tt.config, includeLine)
+			if got != tt.want {
+				t.Errorf("mergeIncludeLine(%q) = %q, want %q", tt.config, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTsOptions(t *testing.T) {
+	include := tsManagedHeader + "\n" + tsOptionsPrefix + "binary=/usr/bin/tailscale\nHost *.ts.net\n"
+	opts, ok := parseTsOptions(include)
+	if !ok {
+		t.Fatalf("parseTsOptions(%q) found no options line", include)
+	}
+	if got, want := opts["binary"], "/usr/bin/tailscale"; got != want {
+		t.Errorf("opts[binary] = %q, want %q", got, want)
+	}
+
+	if _, ok := parseTsOptions("Host *.ts.net\n"); ok {
+		t.Error("parseTsOptions found an options line where there was none")
+	}
+}
+
+func TestResolveTsOptions(t *testing.T) {
+	requested := tsOptions{"binary": "/usr/bin/tailscale"}
+
+	got, err := resolveTsOptions(requested, nil, false, true)
+	if err != nil {
+		t.Fatalf("resolveTsOptions with nothing persisted: %v", err)
+	}
+	if got.String() != requested.String() {
+		t.Errorf("resolveTsOptions with nothing persisted = %v, want %v", got, requested)
+	}
+
+	same := tsOptions{"binary": "/usr/bin/tailscale"}
+	got, err = resolveTsOptions(requested, same, true, true)
+	if err != nil {
+		t.Fatalf("resolveTsOptions with unchanged options: %v", err)
+	}
+	if got.String() != requested.String() {
+		t.Errorf("resolveTsOptions with unchanged options = %v, want %v", got, requested)
+	}
+
+	persisted := tsOptions{"binary": "/usr/local/bin/tailscale"}
+
+	// Non-interactive (e.g. --diff) without --yes must reuse the persisted
+	// options rather than prompting or silently using the new ones; this is
+	// what keeps --diff's preview in sync with what a real, non-interactive
+	// apply run would do.
+	got, err = resolveTsOptions(requested, persisted, true, false)
+	if err != nil {
+		t.Fatalf("resolveTsOptions non-interactive: %v", err)
+	}
+	if got.String() != persisted.String() {
+		t.Errorf("resolveTsOptions non-interactive = %v, want %v", got, persisted)
+	}
+
+	// When the persisted options differ and --yes was passed, the new
+	// (requested) options win without prompting, interactive or not.
+	old := sshConfigArgs.yes
+	sshConfigArgs.yes = true
+	defer func() { sshConfigArgs.yes = old }()
+
+	got, err = resolveTsOptions(requested, persisted, true, false)
+	if err != nil {
+		t.Fatalf("resolveTsOptions with --yes: %v", err)
+	}
+	if got.String() != requested.String() {
+		t.Errorf("resolveTsOptions with --yes = %v, want %v", got, requested)
+	}
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRunRemoveSSHconfig(t *testing.T) {
+	includeLine := "Include " + filepath.FromSlash("~/.ssh/"+tsIncludeFileName)
+
+	setup := func(t *testing.T, config, include string) string {
+		h := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(h, ".ssh"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if config != "" {
+			if err := os.WriteFile(filepath.Join(h, ".ssh", "config"), []byte(config), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if include != "" {
+			if err := os.WriteFile(filepath.Join(h, ".ssh", tsIncludeFileName), []byte(include), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return h
+	}
+
+	withArgs := func(t *testing.T, yes, diff bool, answer string) {
+		oldYes, oldDiff, oldStdin := sshConfigArgs.yes, sshConfigArgs.diff, sshConfigStdin
+		sshConfigArgs.yes = yes
+		sshConfigArgs.diff = diff
+		sshConfigStdin = bufio.NewReader(strings.NewReader(answer))
+		t.Cleanup(func() {
+			sshConfigArgs.yes = oldYes
+			sshConfigArgs.diff = oldDiff
+			sshConfigStdin = oldStdin
+		})
+	}
+
+	t.Run("removes legacy block", func(t *testing.T) {
+		h := setup(t, "Host example.com\n"+
+			"  User alice\n"+
+			tsConfigStartMark+"\n"+
+			"Host *.ts.net\n"+
+			"  UserKnownHostsFile /dev/null\n"+
+			tsConfigEndMark+"\n", "")
+		withArgs(t, true, false, "")
+
+		if err := runRemoveSSHconfig(h); err != nil {
+			t.Fatalf("runRemoveSSHconfig: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(h, ".ssh", "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Host example.com\n  User alice\n"; string(got) != want {
+			t.Errorf("config = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("removes include line and file", func(t *testing.T) {
+		h := setup(t, includeLine+"\nHost example.com\n  User alice\n", tsManagedHeader+"\n")
+		withArgs(t, true, false, "")
+
+		if err := runRemoveSSHconfig(h); err != nil {
+			t.Fatalf("runRemoveSSHconfig: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(h, ".ssh", "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Host example.com\n  User alice\n"; string(got) != want {
+			t.Errorf("config = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(filepath.Join(h, ".ssh", tsIncludeFileName)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("include file still exists, err = %v", err)
+		}
+	})
+
+	t.Run("nothing to do", func(t *testing.T) {
+		h := setup(t, "Host example.com\n  User alice\n", "")
+		withArgs(t, true, false, "")
+
+		if err := runRemoveSSHconfig(h); err != nil {
+			t.Fatalf("runRemoveSSHconfig: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(h, ".ssh", "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Host example.com\n  User alice\n"; string(got) != want {
+			t.Errorf("config changed unexpectedly = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("diff reports pending changes without writing", func(t *testing.T) {
+		h := setup(t, includeLine+"\nHost example.com\n  User alice\n", tsManagedHeader+"\n")
+		withArgs(t, false, true, "")
+
+		if err := runRemoveSSHconfig(h); !errors.Is(err, errChangesPending) {
+			t.Fatalf("runRemoveSSHconfig with --diff = %v, want errChangesPending", err)
+		}
+		got, err := os.ReadFile(filepath.Join(h, ".ssh", "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := includeLine + "\nHost example.com\n  User alice\n"; string(got) != want {
+			t.Errorf("config changed by --diff = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(filepath.Join(h, ".ssh", tsIncludeFileName)); err != nil {
+			t.Errorf("include file removed by --diff, err = %v", err)
+		}
+	})
+
+	t.Run("declining the confirm prompt leaves files alone", func(t *testing.T) {
+		h := setup(t, includeLine+"\nHost example.com\n  User alice\n", tsManagedHeader+"\n")
+		withArgs(t, false, false, "n\n")
+
+		if err := runRemoveSSHconfig(h); err != nil {
+			t.Fatalf("runRemoveSSHconfig: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(h, ".ssh", "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := includeLine + "\nHost example.com\n  User alice\n"; string(got) != want {
+			t.Errorf("config changed after declining = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(filepath.Join(h, ".ssh", tsIncludeFileName)); err != nil {
+			t.Errorf("include file removed after declining, err = %v", err)
+		}
+	})
+
+	t.Run("accepting the confirm prompt removes files", func(t *testing.T) {
+		h := setup(t, includeLine+"\nHost example.com\n  User alice\n", tsManagedHeader+"\n")
+		withArgs(t, false, false, "y\n")
+
+		if err := runRemoveSSHconfig(h); err != nil {
+			t.Fatalf("runRemoveSSHconfig: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(h, ".ssh", "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Host example.com\n  User alice\n"; string(got) != want {
+			t.Errorf("config = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(filepath.Join(h, ".ssh", tsIncludeFileName)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("include file still exists, err = %v", err)
+		}
+	})
+}
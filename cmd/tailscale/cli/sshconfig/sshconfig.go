@@ -0,0 +1,126 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package sshconfig is a small ssh_config-aware helper used by `tailscale
+// configure sshconfig` to detect when a user's existing ssh_config would
+// conflict with the options Tailscale wants to install, instead of treating
+// the file as an opaque blob of lines.
+package sshconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// Conflict describes an existing Host block or global option in a user's
+// ssh_config that would be shadowed by (or would shadow) one of Tailscale's
+// managed options.
+type Conflict struct {
+	File string // path the conflict was found in, for display purposes
+	Host string // the conflicting Host pattern, or "" for a global option
+	Key  string // the conflicting option name, e.g. UserKnownHostsFile, or "" for a conflicting Host block
+	// Line is the 1-based line number of the conflicting option. For a
+	// conflicting Host block it is the line of the block's first entry after
+	// its Host line, or 0 if the block has no entries.
+	Line int
+}
+
+func (c Conflict) String() string {
+	if c.Key == "" {
+		return fmt.Sprintf("%s:%d: existing \"Host %s\" block", c.File, c.Line, c.Host)
+	}
+	if c.Host == "" {
+		return fmt.Sprintf("%s:%d: existing global %q option", c.File, c.Line, c.Key)
+	}
+	return fmt.Sprintf("%s:%d: existing \"Host %s\" block sets %q", c.File, c.Line, c.Host, c.Key)
+}
+
+// FindConflicts parses config (the contents of an ssh_config file) and
+// reports any Host block whose patterns include pattern (whether pattern is
+// the block's only pattern or one of several on the same Host line), and
+// any option among keys that is already set by another Host block or
+// globally, either of which would conflict with installing a Host block
+// for pattern setting keys. file is used only to label the returned
+// Conflicts.
+func FindConflicts(file, config, pattern string, keys []string) ([]Conflict, error) {
+	cfg, err := ssh_config.Decode(strings.NewReader(config))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+
+	var conflicts []Conflict
+	for _, h := range cfg.Hosts {
+		hp := hostPattern(h)
+		if hostMatchesPattern(h, pattern) {
+			conflicts = append(conflicts, Conflict{File: file, Host: hp, Line: firstNodeLine(h)})
+			continue
+		}
+		for _, node := range h.Nodes {
+			kv, ok := node.(*ssh_config.KV)
+			if !ok || !hasKey(keys, kv.Key) {
+				continue
+			}
+			conflicts = append(conflicts, Conflict{
+				File: file,
+				Host: hp,
+				Key:  kv.Key,
+				Line: kv.Pos().Line,
+			})
+		}
+	}
+	return conflicts, nil
+}
+
+// firstNodeLine returns the source line of the first node in h, or 0 if h
+// has no nodes with known position information.
+func firstNodeLine(h *ssh_config.Host) int {
+	for _, node := range h.Nodes {
+		if p, ok := node.(interface{ Pos() ssh_config.Position }); ok {
+			return p.Pos().Line
+		}
+	}
+	return 0
+}
+
+// hostMatchesPattern reports whether pattern is one of h's Patterns,
+// regardless of how many other patterns appear on the same Host line.
+func hostMatchesPattern(h *ssh_config.Host, pattern string) bool {
+	for _, p := range h.Patterns {
+		if p.String() == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPattern returns h's patterns joined back into a single space-separated
+// string, e.g. "*.ts.net" or "foo bar". A Host block with no explicit
+// pattern (the implicit leading block holding global options) reports "".
+func hostPattern(h *ssh_config.Host) string {
+	if h.Patterns == nil {
+		return ""
+	}
+	pats := make([]string, len(h.Patterns))
+	for i, p := range h.Patterns {
+		pats[i] = p.String()
+	}
+	s := strings.Join(pats, " ")
+	if s == "*" {
+		// The synthetic Host * block holding options that appear before any
+		// explicit Host directive; report it as global, not a conflicting
+		// Host block of its own.
+		return ""
+	}
+	return s
+}
+
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
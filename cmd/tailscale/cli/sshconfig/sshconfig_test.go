@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sshconfig
+
+import "testing"
+
+func TestFindConflicts(t *testing.T) {
+	keys := []string{"UserKnownHostsFile", "KnownHostsCommand"}
+
+	tests := []struct {
+		name    string
+		config  string
+		pattern string
+		want    int // number of conflicts expected
+	}{
+		{
+			name:    "empty config",
+			config:  "",
+			pattern: "*.ts.net",
+			want:    0,
+		},
+		{
+			name: "unrelated host block",
+			config: `
+Host example.com
+  User alice
+`,
+			pattern: "*.ts.net",
+			want:    0,
+		},
+		{
+			name: "exact pattern match",
+			config: `
+Host *.ts.net
+  User alice
+`,
+			pattern: "*.ts.net",
+			want:    1,
+		},
+		{
+			name: "pattern is one of several on the Host line",
+			config: `
+Host bastion *.ts.net
+  User alice
+`,
+			pattern: "*.ts.net",
+			want:    1,
+		},
+		{
+			name: "conflicting global option",
+			config: `
+UserKnownHostsFile ~/.ssh/my_known_hosts
+
+Host example.com
+  User alice
+`,
+			pattern: "*.ts.net",
+			want:    1,
+		},
+		{
+			name: "conflicting option on unrelated host block",
+			config: `
+Host example.com
+  KnownHostsCommand /usr/bin/ssh-keygen -F %H
+`,
+			pattern: "*.ts.net",
+			want:    1,
+		},
+		{
+			name: "no conflict for unrelated options",
+			config: `
+Host example.com
+  User alice
+  Port 2222
+`,
+			pattern: "*.ts.net",
+			want:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflicts, err := FindConflicts("ssh_config", tt.config, tt.pattern, keys)
+			if err != nil {
+				t.Fatalf("FindConflicts: %v", err)
+			}
+			if len(conflicts) != tt.want {
+				t.Errorf("FindConflicts(%q) = %v, want %d conflict(s)", tt.config, conflicts, tt.want)
+			}
+		})
+	}
+}